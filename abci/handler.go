@@ -0,0 +1,60 @@
+package abci
+
+import (
+	"github.com/tendermint/abci/types"
+	"github.com/tendermint/iavl"
+	cmn "github.com/tendermint/tmlibs/common"
+	"github.com/tendermint/tmlibs/log"
+)
+
+// Events is the set of tags a TxHandler wants attached to a
+// transaction's ResponseDeliverTx.
+type Events []cmn.KVPair
+
+// Context carries everything a TxHandler needs to check or deliver a
+// transaction, so handlers stay decoupled from the Application struct
+// and downstream projects can add new transaction types without
+// reaching into kchain internals.
+type Context struct {
+	Tree              *iavl.VersionedTree
+	Logger            log.Logger
+	Height            int64
+	SignerPubKey      string
+	GenesisValidators map[string]int64
+	ValUpdates        *[]*types.Validator
+}
+
+// TxHandler lets downstream projects embedding kchain add new
+// transaction types (permissions, namespaces, contract-like modules)
+// without forking DeliverTx/CheckTx.
+type TxHandler interface {
+	Type() string
+	Check(ctx *Context, tx *Transaction) error
+	Deliver(ctx *Context, tx *Transaction) (Events, error)
+}
+
+// HandlerRegistry dispatches a transaction to the TxHandler registered
+// for its Type, replacing the hard-coded switch tx1.Type blocks that
+// used to live in DeliverTx/CheckTx.
+type HandlerRegistry struct {
+	handlers map[string]TxHandler
+}
+
+func NewHandlerRegistry() *HandlerRegistry {
+	return &HandlerRegistry{handlers: make(map[string]TxHandler)}
+}
+
+func (r *HandlerRegistry) Register(h TxHandler) {
+	r.handlers[h.Type()] = h
+}
+
+func (r *HandlerRegistry) Get(txType string) (TxHandler, bool) {
+	h, ok := r.handlers[txType]
+	return h, ok
+}
+
+// RegisterHandler lets downstream projects embedding kchain register a
+// TxHandler for a new transaction type without forking DeliverTx/CheckTx.
+func (app *PersistentApplication) RegisterHandler(h TxHandler) {
+	app.handlers.Register(h)
+}
@@ -0,0 +1,133 @@
+package abci
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+
+	"github.com/tendermint/abci/types"
+
+	"kchain/types/cnst"
+)
+
+// dbSetHandler backs the cnst.DbSet transaction type: arbitrary
+// signed key/value writes into the state tree.
+type dbSetHandler struct{}
+
+func (dbSetHandler) Type() string { return cnst.DbSet }
+
+func (dbSetHandler) Check(ctx *Context, tx *Transaction) error {
+	return tx.CheckDb()
+}
+
+func (dbSetHandler) Deliver(ctx *Context, tx *Transaction) (Events, error) {
+	// DeliverTx runs on whatever a proposer put in the block, not just
+	// txs that already passed CheckTx, so these errors must be
+	// propagated rather than ignored.
+	if err := tx.CheckDb(); err != nil {
+		return nil, err
+	}
+	tx.DbSave()
+
+	db, err := tx.ToDb()
+	if err != nil {
+		return nil, err
+	}
+	return Events{
+		{Key: []byte("db.key"), Value: []byte(db.Key)},
+		{Key: []byte("db.signer"), Value: []byte(ctx.SignerPubKey)},
+	}, nil
+}
+
+// accountSetHandler backs the cnst.AccountSet transaction type:
+// registering the power of an account pubkey, gated on the signer
+// being one of the genesis validators.
+type accountSetHandler struct{}
+
+func (accountSetHandler) Type() string { return cnst.AccountSet }
+
+func (accountSetHandler) Check(ctx *Context, tx *Transaction) error {
+	if ctx.GenesisValidators[ctx.SignerPubKey] == 0 {
+		return fmt.Errorf("验证节点错误")
+	}
+	_, err := tx.ToAccount()
+	return err
+}
+
+func (accountSetHandler) Deliver(ctx *Context, tx *Transaction) (Events, error) {
+	// DeliverTx runs on whatever a proposer put in the block, not just
+	// txs that already passed CheckTx, so this gate must be re-checked
+	// here too or a malicious proposer could push an unauthorized
+	// AccountSet straight into DeliverTx.
+	if ctx.GenesisValidators[ctx.SignerPubKey] == 0 {
+		return nil, fmt.Errorf("验证节点错误")
+	}
+	account, err := tx.ToAccount()
+	if err != nil {
+		return nil, err
+	}
+	ctx.Tree.Set([]byte(cnst.AccountPrefix+account.PubKey), []byte(strconv.Itoa(account.Power)))
+
+	return Events{
+		{Key: []byte("account.pubkey"), Value: []byte(account.PubKey)},
+		{Key: []byte("account.power"), Value: []byte(strconv.Itoa(account.Power))},
+	}, nil
+}
+
+// validatorSetHandler backs the cnst.ValidatorSet transaction type:
+// adding, updating, or removing a validator, also gated on the signer
+// being a genesis validator.
+type validatorSetHandler struct{}
+
+func (validatorSetHandler) Type() string { return cnst.ValidatorSet }
+
+func (validatorSetHandler) Check(ctx *Context, tx *Transaction) error {
+	if ctx.GenesisValidators[ctx.SignerPubKey] == 0 {
+		return fmt.Errorf("验证节点错误")
+	}
+	_, err := tx.ToValidator()
+	return err
+}
+
+func (validatorSetHandler) Deliver(ctx *Context, tx *Transaction) (Events, error) {
+	// See accountSetHandler.Deliver: CheckTx passing is not guaranteed
+	// for block content a proposer delivers, so re-enforce the gate.
+	if ctx.GenesisValidators[ctx.SignerPubKey] == 0 {
+		return nil, fmt.Errorf("验证节点错误")
+	}
+	val, err := tx.ToValidator()
+	if err != nil {
+		return nil, err
+	}
+
+	key := []byte(ValidatorSetChangePrefix + string(val.PubKey))
+	action := "add"
+	wasPresent := ctx.Tree.Has(key)
+
+	if val.Power == 0 {
+		if !wasPresent {
+			return nil, fmt.Errorf("cannot remove non-existent validator %X", key)
+		}
+		ctx.Tree.Remove(key)
+		action = "remove"
+	} else {
+		value := bytes.NewBuffer(make([]byte, 0))
+		if err := types.WriteMessage(&types.Validator{val.PubKey, val.Power}, value); err != nil {
+			return nil, fmt.Errorf("error encoding validator: %v", err)
+		}
+		ctx.Tree.Set(key, value.Bytes())
+		if wasPresent {
+			action = "update"
+		}
+	}
+
+	// we only update the changes array if we successfully updated the tree
+	*ctx.ValUpdates = append(*ctx.ValUpdates, &types.Validator{val.PubKey, val.Power})
+
+	return Events{
+		{Key: []byte("validator.pubkey"), Value: []byte(hex.EncodeToString(val.PubKey))},
+		{Key: []byte("validator.power"), Value: []byte(strconv.FormatInt(val.Power, 10))},
+		{Key: []byte("validator.action"), Value: []byte(action)},
+	}, nil
+}
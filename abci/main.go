@@ -2,10 +2,12 @@ package abci
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/tendermint/abci/types"
 	crypto "github.com/tendermint/go-crypto"
@@ -23,12 +25,122 @@ import (
 
 var _ types.Application = (*PersistentApplication)(nil)
 
-type PersistentApplication struct {
+// Application holds the in-memory KV logic shared by every kchain ABCI
+// app. It is safe for concurrent use: every exported ABCI method takes
+// mtx before touching state, ValUpdates or GenesisValidators. The
+// storage backend is whatever dbm.DB is handed to NewApplication, so
+// the same logic runs against a memdb in tests and a LevelDB in prod.
+type Application struct {
 	types.BaseApplication
+
+	mtx               sync.Mutex
+	db                dbm.DB
 	state             *iavl.VersionedTree
 	ValUpdates        []*types.Validator
 	GenesisValidators map[string]int64
-	logger            log.Logger
+	// valAddrToPubKeyMap indexes GenesisValidators by address rather
+	// than raw pubkey bytes, so ByzantineValidators/evictions coming
+	// off RequestBeginBlock can be resolved without re-deriving keys.
+	valAddrToPubKeyMap map[string]crypto.PubKey
+	// genesisValidatorsLoaded marks that loadGenesisValidators has run
+	// at least once, so a chain with no genesis validators doesn't
+	// pay for a full prefix scan on every CheckTx/DeliverTx.
+	genesisValidatorsLoaded bool
+	handlers                *HandlerRegistry
+	logger                  log.Logger
+}
+
+// GenesisValidatorPrefix namespaces the genesis validator set's entries
+// in the IAVL tree, separate from the live "val:" validator-set prefix
+// so the two never collide.
+const GenesisValidatorPrefix = "gval:"
+
+func NewApplication(db dbm.DB, log1 log.Logger) *Application {
+	stateTree := iavl.NewVersionedTree(0, db)
+	stateTree.Load()
+
+	app := &Application{
+		db:       db,
+		state:    stateTree,
+		handlers: NewHandlerRegistry(),
+		logger:   log1,
+	}
+	app.loadGenesisValidators()
+	app.registerBuiltinHandlers()
+	return app
+}
+
+// registerBuiltinHandlers wires up the transaction types kchain ships
+// with out of the box. Downstream projects embedding kchain add more
+// via PersistentApplication.RegisterHandler without touching this.
+func (app *Application) registerBuiltinHandlers() {
+	app.handlers.Register(dbSetHandler{})
+	app.handlers.Register(accountSetHandler{})
+	app.handlers.Register(validatorSetHandler{})
+}
+
+// loadGenesisValidators rebuilds GenesisValidators and
+// valAddrToPubKeyMap from the IAVL tree, scanning only the
+// GenesisValidatorPrefix range rather than the whole tree. It is
+// called on startup by NewApplication and again by ApplySnapshotChunk
+// after a restore; CheckTx/DeliverTx call it only when
+// genesisValidatorsLoaded is unset.
+func (app *Application) loadGenesisValidators() {
+	app.GenesisValidators = make(map[string]int64)
+	app.valAddrToPubKeyMap = make(map[string]crypto.PubKey)
+
+	start := []byte(GenesisValidatorPrefix)
+	app.state.IterateRange(start, prefixRangeEnd(start), true, func(key, value []byte) bool {
+		pubKeyBytes := key[len(GenesisValidatorPrefix):]
+		power, err := strconv.ParseInt(string(value), 10, 64)
+		if err != nil {
+			return false
+		}
+		app.GenesisValidators[string(pubKeyBytes)] = power
+
+		if pubKey, err := crypto.PubKeyFromBytes(pubKeyBytes); err == nil {
+			app.valAddrToPubKeyMap[string(pubKey.Address())] = pubKey
+		}
+		return false
+	})
+	app.genesisValidatorsLoaded = true
+}
+
+// prefixRangeEnd returns the smallest key that sorts after every key
+// with the given prefix, so IterateRange(prefix, prefixRangeEnd(prefix))
+// visits exactly that prefix's keys.
+func prefixRangeEnd(prefix []byte) []byte {
+	end := make([]byte, len(prefix))
+	copy(end, prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		end[i]++
+		if end[i] != 0 {
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// PersistentApplication wraps Application with a LevelDB-backed IAVL
+// tree, the storage backend kchain runs in production. It additionally
+// owns the side DB that snapshot chunks are written to for state sync.
+type PersistentApplication struct {
+	*Application
+
+	snapshotDB       dbm.DB
+	snapshotInterval int64
+
+	// restore state tracked across ApplySnapshotChunk calls for the
+	// snapshot currently being restored, set by OfferSnapshot.
+	restoringHeight uint64
+	restoringChunks uint32
+	// restoringChunkHash is the snapshot's own chunk-commitment root
+	// (Snapshot.Hash), used to verify transfer integrity once every
+	// chunk has arrived.
+	restoringChunkHash []byte
+	// restoringAppHash is the trusted light-block AppHash the restored
+	// tree must match once every chunk is applied.
+	restoringAppHash []byte
 }
 
 func Run() *PersistentApplication {
@@ -45,147 +157,131 @@ func NewPersistentApplication(name, dbDir string, log1 log.Logger) *PersistentAp
 		panic(err.Error())
 	}
 
-	stateTree := iavl.NewVersionedTree(0, db)
-	stateTree.Load()
+	snapshotDB, err := dbm.NewGoLevelDB(name+"_snapshots", dbDir)
+	if err != nil {
+		panic(err.Error())
+	}
 
 	return &PersistentApplication{
-		state: stateTree,
-		logger: log1,
+		Application:      NewApplication(db, log1),
+		snapshotDB:       snapshotDB,
+		snapshotInterval: cfg().Config.SnapshotInterval(),
 	}
 }
 
-func (app *PersistentApplication) SetLogger(l log.Logger) {
+func (app *Application) SetLogger(l log.Logger) {
 	app.logger = l
 }
 
-func (app *PersistentApplication) Info(req types.RequestInfo) (res types.ResponseInfo) {
+func (app *Application) Info(req types.RequestInfo) (res types.ResponseInfo) {
+	app.mtx.Lock()
+	defer app.mtx.Unlock()
+
 	res.Data = fmt.Sprintf("{\"size\":%v}", app.state.Size())
 	res.LastBlockHeight = int64(app.state.LatestVersion())
 	res.LastBlockAppHash = app.state.Hash()
 	return
 }
 
-func (app *PersistentApplication) SetOption(req types.RequestSetOption) types.ResponseSetOption {
+func (app *Application) SetOption(req types.RequestSetOption) types.ResponseSetOption {
 	return types.ResponseSetOption{Code: types.CodeTypeOK}
 }
 
 // tx is either "val:pubkey/power" or "key=value" or just arbitrary bytes
-func (app *PersistentApplication) DeliverTx(txBytes []byte) types.ResponseDeliverTx {
-	tx1 := &Transaction{}
-	tx1.FromBytes(txBytes)
+func (app *Application) DeliverTx(txBytes []byte) types.ResponseDeliverTx {
+	app.mtx.Lock()
+	defer app.mtx.Unlock()
 
-	switch tx1.Type {
-	case cnst.DbSet:
-		tx1.CheckDb()
-		tx1.DbSave()
-
-	case cnst.AccountSet:
-		account, _ := tx1.ToAccount()
-		app.state.Set([]byte(cnst.AccountPrefix + account.PubKey), []byte(strconv.Itoa(account.Power)))
+	if !app.genesisValidatorsLoaded {
+		app.loadGenesisValidators()
+	}
 
-	case cnst.ValidatorSet:
-		val, _ := tx1.ToValidator()
-		key := []byte(ValidatorSetChangePrefix + string(val.PubKey))
+	tx1 := &Transaction{}
+	tx1.FromBytes(txBytes)
 
-		if val.Power == 0 {
-			if !app.state.Has(key) {
-				return types.ResponseDeliverTx{
-					Code: code.CodeTypeUnauthorized.Code,
-					Log:  fmt.Sprintf("Cannot remove non-existent validator %X", key)}
-			}
-			app.state.Remove(key)
-		} else {
-			// add or update validator
-			value := bytes.NewBuffer(make([]byte, 0))
-			if err := types.WriteMessage(&types.Validator{val.PubKey, val.Power}, value); err != nil {
-				return types.ResponseDeliverTx{
-					Code: code.CodeTypeEncodingError.Code,
-					Log:  fmt.Sprintf("Error encoding validator: %v", err)}
-			}
-			app.state.Set(key, value.Bytes())
+	handler, ok := app.handlers.Get(tx1.Type)
+	if !ok {
+		return types.ResponseDeliverTx{
+			Code: code.CodeTypeEncodingError.Code,
+			Log:  "unknown transaction type",
 		}
+	}
 
-		// we only update the changes array if we successfully updated the tree
-		app.ValUpdates = append(app.ValUpdates, &types.Validator{val.PubKey, val.Power})
-
-
-
-	default:
+	events, err := handler.Deliver(app.txContext(tx1), tx1)
+	if err != nil {
 		return types.ResponseDeliverTx{
-			Code:code.CodeTypeEncodingError.Code,
-			Log:"unknown transaction type",
+			Code: code.CodeTypeEncodingError.Code,
+			Log:  err.Error(),
 		}
 	}
 
-	return types.ResponseDeliverTx{Code: code.Ok.Code}
+	txHash := sha256.Sum256(txBytes)
+	tags := append([]cmn.KVPair(events), cmn.KVPair{Key: []byte("tx.hash"), Value: []byte(hex.EncodeToString(txHash[:]))})
+
+	return types.ResponseDeliverTx{Code: code.Ok.Code, Tags: tags}
 }
 
-func (app *PersistentApplication) CheckTx(txBytes []byte) types.ResponseCheckTx {
+func (app *Application) CheckTx(txBytes []byte) types.ResponseCheckTx {
+	app.mtx.Lock()
+	defer app.mtx.Unlock()
+
+	if !app.genesisValidatorsLoaded {
+		app.loadGenesisValidators()
+	}
+
 	tx1 := &Transaction{}
 	if err := tx1.FromBytes(txBytes); err != nil {
-		return types.ResponseDeliverTx{
-			Code:code.CodeTypeEncodingError.Code,
-			Log:err.Error(),
+		return types.ResponseCheckTx{
+			Code: code.CodeTypeEncodingError.Code,
+			Log:  err.Error(),
 		}
 	}
 
 	if strings.Compare(tx1.Signature, "") != 0 {
 		if index, _ := app.state.Get([]byte(AccountSetChangePrefix + tx1.SignPubKey)); index == 0 {
-			return types.ResponseDeliverTx{
-				Code:code.CodeTypeEncodingError.Code,
-				Log:"节点账户不存在",
+			return types.ResponseCheckTx{
+				Code: code.CodeTypeEncodingError.Code,
+				Log:  "节点账户不存在",
 			}
 		}
 	}
 
-	switch tx1.Type {
-	case cnst.DbSet:
-		if err := tx1.CheckDb(); err != nil {
-			return types.ResponseDeliverTx{
-				Code:code.CodeTypeEncodingError.Code,
-				Log:err.Error(),
-			}
-		}
-	case cnst.AccountSet:
-		if app.GenesisValidators[tx1.SignPubKey] == 0 {
-			return types.ResponseDeliverTx{
-				Code:code.CodeTypeEncodingError.Code,
-				Log:"验证节点错误",
-			}
-		}
-
-		if _, err := tx1.ToAccount(); err != nil {
-			return types.ResponseDeliverTx{
-				Code:code.CodeTypeEncodingError.Code,
-				Log:err.Error(),
-			}
-		}
-
-	case cnst.ValidatorSet:
-		if app.GenesisValidators[tx1.SignPubKey] == 0 {
-			return types.ResponseDeliverTx{
-				Code:code.CodeTypeEncodingError.Code,
-				Log:"验证节点错误",
-			}
+	handler, ok := app.handlers.Get(tx1.Type)
+	if !ok {
+		return types.ResponseCheckTx{
+			Code: code.CodeTypeEncodingError.Code,
+			Log:  "unknown transaction type",
 		}
+	}
 
-		if _, err := tx1.ToValidator(); err != nil {
-			return types.ResponseDeliverTx{
-				Code:code.CodeTypeEncodingError.Code,
-				Log:err.Error(),
-			}
-		}
-	default:
-		return types.ResponseDeliverTx{
-			Code:code.CodeTypeEncodingError.Code,
-			Log:"unknown transaction type",
+	if err := handler.Check(app.txContext(tx1), tx1); err != nil {
+		return types.ResponseCheckTx{
+			Code: code.CodeTypeEncodingError.Code,
+			Log:  err.Error(),
 		}
 	}
 	return types.ResponseCheckTx{Code: code.Ok.Code}
 }
 
+// txContext builds the Context a TxHandler needs to check or deliver
+// tx1, sharing the tree, logger and validator-update slice with the
+// rest of the Application. Callers must already hold app.mtx.
+func (app *Application) txContext(tx1 *Transaction) *Context {
+	return &Context{
+		Tree:              app.state,
+		Logger:            app.logger,
+		Height:            int64(app.state.LatestVersion()) + 1,
+		SignerPubKey:      tx1.SignPubKey,
+		GenesisValidators: app.GenesisValidators,
+		ValUpdates:        &app.ValUpdates,
+	}
+}
+
 // Commit will panic if InitChain was not called
-func (app *PersistentApplication) Commit() (res types.ResponseCommit) {
+func (app *Application) Commit() (res types.ResponseCommit) {
+	app.mtx.Lock()
+	defer app.mtx.Unlock()
+
 	// Save a new version for next height
 	height := app.state.LatestVersion() + 1
 	if appHash, err := app.state.SaveVersion(height); err != nil {
@@ -196,7 +292,10 @@ func (app *PersistentApplication) Commit() (res types.ResponseCommit) {
 	}
 }
 
-func (app *PersistentApplication) Query(reqQuery types.RequestQuery) (resQuery types.ResponseQuery) {
+func (app *Application) Query(reqQuery types.RequestQuery) (resQuery types.ResponseQuery) {
+	app.mtx.Lock()
+	defer app.mtx.Unlock()
+
 	var (
 		data = reqQuery.Data
 		path = reqQuery.Path
@@ -212,7 +311,50 @@ func (app *PersistentApplication) Query(reqQuery types.RequestQuery) (resQuery t
 			return
 		}
 		app.logger.Error(db.Key, "search", "abci")
-		index, value := app.state.Get([]byte(db.Key))
+
+		height := reqQuery.Height
+		if height == 0 {
+			height = int64(app.state.LatestVersion())
+		}
+		resQuery.Height = height
+
+		var (
+			index int32
+			value []byte
+		)
+		if reqQuery.Prove {
+			var err error
+			value, err = app.state.GetVersioned([]byte(db.Key), height)
+			if err != nil {
+				resQuery.Code = code.CodeTypeInternalError.Code
+				resQuery.Log = err.Error()
+				return
+			}
+
+			proof, err := app.state.GetVersionedWithProof([]byte(db.Key), height)
+			if err != nil {
+				resQuery.Code = code.CodeTypeInternalError.Code
+				resQuery.Log = err.Error()
+				return
+			}
+			proofBytes, err := proof.Bytes()
+			if err != nil {
+				resQuery.Code = code.CodeTypeInternalError.Code
+				resQuery.Log = err.Error()
+				return
+			}
+			resQuery.Proof = proofBytes
+		} else if height == int64(app.state.LatestVersion()) {
+			index, value = app.state.Get([]byte(db.Key))
+		} else {
+			var err error
+			value, err = app.state.GetVersioned([]byte(db.Key), height)
+			if err != nil {
+				resQuery.Code = code.CodeTypeInternalError.Code
+				resQuery.Log = err.Error()
+				return
+			}
+		}
 
 		app.logger.Error(string(value), "search", "abci")
 
@@ -225,6 +367,46 @@ func (app *PersistentApplication) Query(reqQuery types.RequestQuery) (resQuery t
 		} else {
 			resQuery.Log = "does not exist"
 		}
+
+	case cnst.DbGetRange:
+		dbRange := &ktx.DbRange{}
+		if err := json.Unmarshal(data, dbRange); err != nil {
+			resQuery.Code = code.CodeTypeBadNonce.Code
+			resQuery.Log = err.Error()
+			return
+		}
+
+		height := reqQuery.Height
+		if height == 0 {
+			height = int64(app.state.LatestVersion())
+		}
+		resQuery.Height = height
+
+		// getRange reads the latest tree only, so a range at any other
+		// height is refused rather than answered with latest data.
+		if height != int64(app.state.LatestVersion()) {
+			resQuery.Code = code.CodeTypeBadNonce.Code
+			resQuery.Log = "range queries are served at the latest height only"
+			return
+		}
+
+		kvs, proof, err := app.getRange([]byte(dbRange.StartKey), []byte(dbRange.EndKey), reqQuery.Prove)
+		if err != nil {
+			resQuery.Code = code.CodeTypeInternalError.Code
+			resQuery.Log = err.Error()
+			return
+		}
+		resQuery.Proof = proof
+
+		rangeBytes, err := json.Marshal(kvs)
+		if err != nil {
+			resQuery.Code = code.CodeTypeEncodingError.Code
+			resQuery.Log = err.Error()
+			return
+		}
+		resQuery.Value = rangeBytes
+		resQuery.Log = fmt.Sprintf("%d keys", len(kvs))
+
 	default:
 		resQuery.Code = code.CodeTypeBadNonce.Code
 		resQuery.Log = "wrong path"
@@ -232,36 +414,99 @@ func (app *PersistentApplication) Query(reqQuery types.RequestQuery) (resQuery t
 	return
 }
 
+// KVWithProof is a single sorted key/value pair returned by a range
+// query.
+type KVWithProof struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// getRange collects every key in [startKey, endKey). When prove is
+// requested, it returns a single RangeProof covering the whole range
+// rather than one existence proof per key: a RangeProof also commits
+// to the absence of any key between the ones it returns, so a light
+// client can detect an RPC node that silently omits an interior key —
+// something N independent point proofs could never catch.
+func (app *Application) getRange(startKey, endKey []byte, prove bool) ([]KVWithProof, []byte, error) {
+	if !prove {
+		var kvs []KVWithProof
+		app.state.IterateRange(startKey, endKey, true, func(key, value []byte) bool {
+			kvs = append(kvs, KVWithProof{Key: key, Value: value})
+			return false
+		})
+		return kvs, nil, nil
+	}
+
+	proof, keys, values, err := app.state.GetRangeProof(startKey, endKey, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	proofBytes, err := proof.Bytes()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	kvs := make([]KVWithProof, len(keys))
+	for i := range keys {
+		kvs[i] = KVWithProof{Key: keys[i], Value: values[i]}
+	}
+	return kvs, proofBytes, nil
+}
+
 // Save the validators in the merkle tree
-func (app *PersistentApplication) InitChain(req types.RequestInitChain) types.ResponseInitChain {
+func (app *Application) InitChain(req types.RequestInitChain) types.ResponseInitChain {
+	app.mtx.Lock()
+	defer app.mtx.Unlock()
+
 	for _, v := range req.Validators {
 		r := app.updateValidator(v)
 		if r.IsErr() {
 			app.logger.Error("Error updating validators", "r", r)
-		} else {
-			// 把创世验证者添加进去
-			app.GenesisValidators[string(v.PubKey)] = v.Power
+			continue
+		}
+
+		// 把创世验证者添加进去, persisted so it survives past the
+		// first block instead of living only in memory.
+		app.GenesisValidators[string(v.PubKey)] = v.Power
+		app.state.Set([]byte(GenesisValidatorPrefix+string(v.PubKey)), []byte(strconv.FormatInt(v.Power, 10)))
+
+		if pubKey, err := crypto.PubKeyFromBytes(v.PubKey); err == nil {
+			app.valAddrToPubKeyMap[string(pubKey.Address())] = pubKey
 		}
 	}
 	return types.ResponseInitChain{}
 }
 
 // Track the block hash and header information
-func (app *PersistentApplication) BeginBlock(req types.RequestBeginBlock) types.ResponseBeginBlock {
-	// reset valset changes
+func (app *Application) BeginBlock(req types.RequestBeginBlock) types.ResponseBeginBlock {
+	app.mtx.Lock()
+	defer app.mtx.Unlock()
+
+	// reset valset changes; GenesisValidators lives in the tree now and
+	// is loaded from it on startup, so it's no longer wiped here every
+	// block.
 	app.ValUpdates = make([]*types.Validator, 0)
-	app.GenesisValidators = make(map[string]int64)
 	return types.ResponseBeginBlock{}
 }
 
 // Update the validator set
-func (app *PersistentApplication) EndBlock(req types.RequestEndBlock) types.ResponseEndBlock {
+func (app *Application) EndBlock(req types.RequestEndBlock) types.ResponseEndBlock {
+	app.mtx.Lock()
+	defer app.mtx.Unlock()
+
 	return types.ResponseEndBlock{ValidatorUpdates: app.ValUpdates}
 }
 
 //---------------------------------------------
-// update validators
-func (app *PersistentApplication) Validators() (validators []*types.Validator) {
+// update validators, both the live set and the genesis set that seeded
+// it (a genesis validator that was never re-added as a "val:" entry
+// would otherwise be invisible here)
+func (app *Application) Validators() (validators []*types.Validator) {
+	app.mtx.Lock()
+	defer app.mtx.Unlock()
+
+	seen := make(map[string]bool)
+
 	app.state.Iterate(func(key, value []byte) bool {
 		if isValidatorTx(key) {
 			validator := new(types.Validator)
@@ -270,9 +515,17 @@ func (app *PersistentApplication) Validators() (validators []*types.Validator) {
 				panic(err)
 			}
 			validators = append(validators, validator)
+			seen[string(validator.PubKey)] = true
 		}
 		return false
 	})
+
+	for pubKey, power := range app.GenesisValidators {
+		if seen[pubKey] {
+			continue
+		}
+		validators = append(validators, &types.Validator{PubKey: []byte(pubKey), Power: power})
+	}
 	return
 }
 
@@ -285,7 +538,7 @@ func isValidatorTx(tx []byte) bool {
 }
 
 // format is "val:pubkey1/power1,addr2/power2,addr3/power3"tx
-func (app *PersistentApplication) execValidatorTx(tx []byte) types.ResponseDeliverTx {
+func (app *Application) execValidatorTx(tx []byte) types.ResponseDeliverTx {
 	tx = tx[len(ValidatorSetChangePrefix):]
 
 	//get the pubkey and power
@@ -324,7 +577,7 @@ func (app *PersistentApplication) execValidatorTx(tx []byte) types.ResponseDeliv
 }
 
 // add, update, or remove a validator
-func (app *PersistentApplication) updateValidator(v *types.Validator) types.ResponseDeliverTx {
+func (app *Application) updateValidator(v *types.Validator) types.ResponseDeliverTx {
 	key := []byte("val:" + string(v.PubKey))
 	if v.Power == 0 {
 		// remove validator
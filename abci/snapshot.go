@@ -0,0 +1,288 @@
+package abci
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+
+	"github.com/tendermint/abci/types"
+)
+
+// snapshotChunkSize is the size each exported tree chunk is split into
+// before being written to the side DB. 16 MiB keeps a chunk well under
+// typical p2p message limits while still being large enough that a
+// full snapshot doesn't need an enormous number of round trips.
+const snapshotChunkSize = 16 * 1024 * 1024
+
+const (
+	// snapshotMetaPrefix namespaces snapshot metadata only
+	// ("snapshot:<height>"); snapshotChunkPrefix namespaces the
+	// (potentially 16 MiB) chunk payloads separately so ListSnapshots
+	// never has to JSON-decode raw chunk bytes.
+	snapshotMetaPrefix  = "snapshot:"
+	snapshotChunkPrefix = "schunk:"
+	restoreChunkPrefix  = "restore:"
+)
+
+// Commit saves the next IAVL version and, every snapshotInterval
+// blocks, exports it as a state-sync snapshot so new nodes can catch
+// up without replaying history from genesis.
+func (app *PersistentApplication) Commit() types.ResponseCommit {
+	res := app.Application.Commit()
+	if res.IsErr() {
+		return res
+	}
+
+	app.mtx.Lock()
+	defer app.mtx.Unlock()
+
+	height := uint64(app.state.LatestVersion())
+	if app.snapshotInterval > 0 && height%uint64(app.snapshotInterval) == 0 {
+		if err := app.takeSnapshot(height); err != nil {
+			app.logger.Error("failed to take snapshot", "height", height, "err", err)
+		}
+	}
+	return res
+}
+
+// snapshotMeta is the metadata types.ListSnapshots hands back to a
+// state-syncing peer so it can decide which snapshot to restore.
+type snapshotMeta struct {
+	Height uint64 `json:"height"`
+	Format uint32 `json:"format"`
+	Chunks uint32 `json:"chunks"`
+	Hash   []byte `json:"hash"`
+}
+
+// takeSnapshot exports the committed tree at height, splits it into
+// fixed-size chunks under "schunk:<height>:<chunk>" in the side DB,
+// and records the chunk count plus a Merkle root of the chunk hashes
+// under "snapshot:<height>" so ListSnapshots can advertise it.
+func (app *PersistentApplication) takeSnapshot(height uint64) error {
+	var kvs []KVWithProof
+	app.state.Iterate(func(key, value []byte) bool {
+		kvs = append(kvs, KVWithProof{Key: key, Value: value})
+		return false
+	})
+	data, err := json.Marshal(kvs)
+	if err != nil {
+		return err
+	}
+
+	chunks := chunkBytes(data, snapshotChunkSize)
+	chunkHashes := make([][]byte, len(chunks))
+	for i, chunk := range chunks {
+		app.snapshotDB.Set(snapshotChunkKey(height, uint32(i)), chunk)
+		h := sha256.Sum256(chunk)
+		chunkHashes[i] = h[:]
+	}
+
+	meta := snapshotMeta{
+		Height: height,
+		Format: 1,
+		Chunks: uint32(len(chunks)),
+		Hash:   merkleRoot(chunkHashes),
+	}
+	metaBytes, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	app.snapshotDB.Set(snapshotMetaKey(height), metaBytes)
+
+	app.logger.Info("Took snapshot", "height", height, "chunks", len(chunks))
+	return nil
+}
+
+// ListSnapshots reports every snapshot this node has available for a
+// state-syncing peer to request.
+func (app *PersistentApplication) ListSnapshots(req types.RequestListSnapshots) types.ResponseListSnapshots {
+	var snapshots []*types.Snapshot
+
+	it := app.snapshotDB.Iterator(nil, nil)
+	defer it.Close()
+	for ; it.Valid(); it.Next() {
+		if !bytes.HasPrefix(it.Key(), []byte(snapshotMetaPrefix)) {
+			continue
+		}
+
+		var meta snapshotMeta
+		if err := json.Unmarshal(it.Value(), &meta); err != nil {
+			app.logger.Error("failed to read snapshot metadata", "err", err)
+			continue
+		}
+		snapshots = append(snapshots, &types.Snapshot{
+			Height: meta.Height,
+			Format: meta.Format,
+			Chunks: meta.Chunks,
+			Hash:   meta.Hash,
+		})
+	}
+	return types.ResponseListSnapshots{Snapshots: snapshots}
+}
+
+// OfferSnapshot validates a peer-advertised snapshot before the node
+// starts pulling chunks for it, rejecting anything that doesn't carry
+// an app hash to restore against.
+func (app *PersistentApplication) OfferSnapshot(req types.RequestOfferSnapshot) types.ResponseOfferSnapshot {
+	if req.Snapshot == nil || len(req.AppHash) == 0 {
+		return types.ResponseOfferSnapshot{Result: types.ResponseOfferSnapshot_REJECT}
+	}
+	app.restoringHeight = req.Snapshot.Height
+	app.restoringChunks = req.Snapshot.Chunks
+	app.restoringChunkHash = req.Snapshot.Hash
+	app.restoringAppHash = req.AppHash
+	return types.ResponseOfferSnapshot{Result: types.ResponseOfferSnapshot_ACCEPT}
+}
+
+// LoadSnapshotChunk serves a single chunk of a previously taken
+// snapshot to a state-syncing peer.
+func (app *PersistentApplication) LoadSnapshotChunk(req types.RequestLoadSnapshotChunk) types.ResponseLoadSnapshotChunk {
+	chunk := app.snapshotDB.Get(snapshotChunkKey(req.Height, req.Chunk))
+	return types.ResponseLoadSnapshotChunk{Chunk: chunk}
+}
+
+// ApplySnapshotChunk buffers chunks as they arrive; once every chunk
+// promised by the offered snapshot is in hand, it verifies the chunk
+// hashes against the snapshot's root and bulk-loads the reassembled
+// tree into the IAVL store.
+func (app *PersistentApplication) ApplySnapshotChunk(req types.RequestApplySnapshotChunk) types.ResponseApplySnapshotChunk {
+	app.snapshotDB.Set(restoreChunkKey(req.Index), req.Chunk)
+
+	if uint32(len(app.restoreChunks())) < app.restoringChunks {
+		return types.ResponseApplySnapshotChunk{Result: types.ResponseApplySnapshotChunk_ACCEPT}
+	}
+
+	chunks := app.restoreChunks()
+	chunkHashes := make([][]byte, len(chunks))
+	for i, chunk := range chunks {
+		h := sha256.Sum256(chunk)
+		chunkHashes[i] = h[:]
+	}
+	// Verifies transfer integrity: the chunks we actually received
+	// hash to the commitment the snapshot advertised in ListSnapshots.
+	if !bytes.Equal(merkleRoot(chunkHashes), app.restoringChunkHash) {
+		app.logger.Error("snapshot chunk hash mismatch on restore", "height", app.restoringHeight)
+		app.clearRestoreChunks()
+		return types.ResponseApplySnapshotChunk{Result: types.ResponseApplySnapshotChunk_ABORT}
+	}
+
+	var data []byte
+	for _, chunk := range chunks {
+		data = append(data, chunk...)
+	}
+
+	var kvs []KVWithProof
+	if err := json.Unmarshal(data, &kvs); err != nil {
+		app.logger.Error("failed to decode reassembled snapshot", "err", err)
+		app.clearRestoreChunks()
+		return types.ResponseApplySnapshotChunk{Result: types.ResponseApplySnapshotChunk_ABORT}
+	}
+
+	app.mtx.Lock()
+	defer app.mtx.Unlock()
+	defer app.clearRestoreChunks()
+
+	if app.state.LatestVersion() >= int64(app.restoringHeight) {
+		app.logger.Error("refusing to restore snapshot over existing version history",
+			"height", app.restoringHeight, "latest", app.state.LatestVersion())
+		return types.ResponseApplySnapshotChunk{Result: types.ResponseApplySnapshotChunk_ABORT}
+	}
+
+	for _, kv := range kvs {
+		app.state.Set(kv.Key, kv.Value)
+	}
+	if _, err := app.state.SaveVersion(int64(app.restoringHeight)); err != nil {
+		app.logger.Error("failed to save restored tree", "err", err)
+		return types.ResponseApplySnapshotChunk{Result: types.ResponseApplySnapshotChunk_ABORT}
+	}
+
+	// The chunk transfer can only be trusted to reproduce what the
+	// remote peer sent, not that it matches consensus: confirm the
+	// restored tree's root matches the trusted light-block AppHash.
+	if !bytes.Equal(app.state.Hash(), app.restoringAppHash) {
+		app.logger.Error("restored app hash mismatch", "height", app.restoringHeight)
+		return types.ResponseApplySnapshotChunk{Result: types.ResponseApplySnapshotChunk_ABORT}
+	}
+
+	// The restored tree carries its own "gval:" entries, but the
+	// in-memory GenesisValidators/valAddrToPubKeyMap built by
+	// NewApplication on the (then-empty) tree predate this data and
+	// must be rebuilt, or CheckTx/DeliverTx will reject every
+	// AccountSet/ValidatorSet tx on this node from now on.
+	app.loadGenesisValidators()
+
+	app.logger.Info("Applied snapshot", "height", app.restoringHeight)
+	return types.ResponseApplySnapshotChunk{Result: types.ResponseApplySnapshotChunk_ACCEPT}
+}
+
+// clearRestoreChunks drops the scratch "restore:<i>" entries written
+// to the snapshot side DB while reassembling a chunk transfer, whether
+// the restore succeeded or was aborted.
+func (app *PersistentApplication) clearRestoreChunks() {
+	for i := uint32(0); i < app.restoringChunks; i++ {
+		app.snapshotDB.Delete(restoreChunkKey(i))
+	}
+}
+
+// restoreChunks reads back the in-progress restore's chunks in order.
+func (app *PersistentApplication) restoreChunks() [][]byte {
+	var chunks [][]byte
+	for i := uint32(0); i < app.restoringChunks; i++ {
+		chunk := app.snapshotDB.Get(restoreChunkKey(i))
+		if chunk == nil {
+			return chunks
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+func chunkBytes(data []byte, size int) [][]byte {
+	var chunks [][]byte
+	for len(data) > 0 {
+		n := size
+		if n > len(data) {
+			n = len(data)
+		}
+		chunks = append(chunks, data[:n])
+		data = data[n:]
+	}
+	return chunks
+}
+
+// merkleRoot folds a list of chunk hashes into a single root hash, so
+// a snapshot's integrity can be checked with one comparison instead of
+// one per chunk.
+func merkleRoot(hashes [][]byte) []byte {
+	if len(hashes) == 0 {
+		h := sha256.Sum256(nil)
+		return h[:]
+	}
+	level := hashes
+	for len(level) > 1 {
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			sum := sha256.Sum256(append(append([]byte{}, level[i]...), level[i+1]...))
+			next = append(next, sum[:])
+		}
+		level = next
+	}
+	return level[0]
+}
+
+func snapshotMetaKey(height uint64) []byte {
+	return []byte(fmt.Sprintf("%s%d", snapshotMetaPrefix, height))
+}
+
+func snapshotChunkKey(height uint64, chunk uint32) []byte {
+	return []byte(fmt.Sprintf("%s%d:%d", snapshotChunkPrefix, height, chunk))
+}
+
+func restoreChunkKey(index uint32) []byte {
+	return []byte(fmt.Sprintf("%s%d", restoreChunkPrefix, index))
+}